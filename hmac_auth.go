@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var keysFile = flag.String("keys", "", "path to a keyring file of \"keyid:secret\" lines, one per key, used for HMAC request authentication")
+
+const (
+	authScheme    = "DPHARMD1"
+	maxClockSkew  = 5 * time.Minute
+	maxSeenNonces = 10000
+)
+
+// keyringValue holds the current map[string][]byte of keyid -> secret. It's
+// an atomic.Value rather than a plain map so reloadKeyringOnSIGHUP can swap
+// in a freshly-read keyring while requests are concurrently looking keys up
+// in authenticate, without either side taking a lock.
+var keyringValue atomic.Value
+
+// setKeyring installs keys as the active keyring.
+func setKeyring(keys map[string][]byte) {
+	keyringValue.Store(keys)
+}
+
+// lookupKey returns the secret for keyID in the active keyring, if any.
+func lookupKey(keyID string) ([]byte, bool) {
+	keys, _ := keyringValue.Load().(map[string][]byte)
+	secret, ok := keys[keyID]
+	return secret, ok
+}
+
+// hupChan receives SIGHUP for the lifetime of the process. It's registered
+// in init, not inside reloadKeyringOnSIGHUP, so the signal is never left
+// undelivered (and fatally terminating the process, SIGHUP's default
+// disposition) during the brief window between the daemon starting and the
+// reload goroutine getting scheduled.
+var hupChan = make(chan os.Signal, 1)
+
+func init() {
+	signal.Notify(hupChan, syscall.SIGHUP)
+}
+
+// reloadKeyringOnSIGHUP re-reads the keyring file at path and installs it
+// every time the daemon receives SIGHUP, so keys can be rotated - added,
+// removed, or replaced - without restarting the daemon. It runs until the
+// process exits; a keyring that fails to parse or can't be read is logged
+// and the previous keyring is left in place.
+func reloadKeyringOnSIGHUP(path string) {
+	for range hupChan {
+		keys, err := loadKeyring(path)
+		if err != nil {
+			log.Printf("reloading keyring %q: %v (keeping previous keyring)", path, err)
+			continue
+		}
+		setKeyring(keys)
+		log.Printf("reloaded keyring %q (%d keys)", path, len(keys))
+	}
+}
+
+// loadKeyring reads a keyring file of "keyid:secret" lines (blank lines and
+// lines starting with "#" are ignored) into an id -> secret map. Keys can be
+// rotated by editing this file and sending the daemon SIGHUP; see
+// reloadKeyringOnSIGHUP.
+func loadKeyring(path string) (map[string][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := map[string][]byte{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, secret, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed keyring line %q", line)
+		}
+		keys[id] = []byte(secret)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// nonceCache remembers the (keyid, nonce) pairs seen within the clock-skew
+// window, evicting the oldest entry once it grows past maxSeenNonces, so a
+// captured request can't be replayed.
+type nonceCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	index    map[string]*list.Element
+}
+
+func newNonceCache(capacity int) *nonceCache {
+	return &nonceCache{capacity: capacity, order: list.New(), index: map[string]*list.Element{}}
+}
+
+// claim atomically checks whether key (typically "keyid:nonce") has already
+// been recorded and, if not, records it, all under a single lock. It
+// reports whether the claim succeeded: false means key was already present,
+// i.e. this is a replay (either of a request still being verified, or one
+// whose signature already checked out). Claiming before the signature is
+// known to be valid is deliberate: two requests racing on the same
+// keyid/nonce/sig must not both be allowed to proceed just because neither
+// has finished hashing its body yet. Callers must release the claim if the
+// request subsequently turns out not to carry a valid signature, or a
+// legitimate retry with a fresh nonce would be indistinguishable from one
+// replaying a stale, never-authenticated nonce forever.
+func (c *nonceCache) claim(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.index[key]; ok {
+		return false
+	}
+
+	c.index[key] = c.order.PushBack(key)
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Front()
+		c.order.Remove(oldest)
+		delete(c.index, oldest.Value.(string))
+	}
+	return true
+}
+
+// release un-claims key, e.g. after its signature turned out not to verify.
+func (c *nonceCache) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.index[key]; ok {
+		c.order.Remove(elem)
+		delete(c.index, key)
+	}
+}
+
+var nonces = newNonceCache(maxSeenNonces)
+
+// authState carries everything needed to finish verifying a request's HMAC
+// signature once its body has been fully read (and hashed) by the handler
+// that processes it.
+type authState struct {
+	secret      []byte
+	method      string
+	path        string
+	rawQuery    string
+	ts          string
+	nonce       string
+	nonceKey    string
+	providedSig []byte
+	hasher      hash.Hash
+}
+
+type authStateKey struct{}
+
+// authenticate parses and structurally validates the Authorization header
+// (known key id, clock skew, replay), then wraps r.Body with a SHA-256
+// hasher so the eventual body digest can be folded into the signature
+// check. It does not verify the signature itself, since that requires the
+// hash of the full body, which isn't known until the caller has read it;
+// call verifyBody once the body has been consumed. The nonce is claimed
+// here, atomically with the replay check, rather than recorded once
+// verifyBody later confirms the signature: the body of a large upload can
+// take a long time to stream, and a replayed request racing the original
+// would otherwise sail through verifyBody too, since neither copy has
+// recorded the nonce yet. verifyBody releases the claim if the signature
+// turns out not to verify.
+func authenticate(r *http.Request) (*http.Request, error) {
+	header := r.Header.Get("Authorization")
+	scheme, rest, ok := strings.Cut(header, " ")
+	if !ok || scheme != authScheme {
+		return nil, fmt.Errorf("missing or malformed Authorization header")
+	}
+
+	params, err := parseAuthParams(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	keyID, ts, nonce, sigStr := params["keyid"], params["ts"], params["nonce"], params["sig"]
+	if keyID == "" || ts == "" || nonce == "" || sigStr == "" {
+		return nil, fmt.Errorf("Authorization header missing keyid, ts, nonce, or sig")
+	}
+
+	secret, ok := lookupKey(keyID)
+	if !ok {
+		return nil, fmt.Errorf("unknown keyid %q", keyID)
+	}
+
+	tsUnix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed ts %q", ts)
+	}
+	skew := time.Since(time.Unix(tsUnix, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > maxClockSkew {
+		return nil, fmt.Errorf("timestamp %q outside the %s allowed clock skew", ts, maxClockSkew)
+	}
+
+	nonceKey := keyID + ":" + nonce
+	if !nonces.claim(nonceKey) {
+		return nil, fmt.Errorf("replayed nonce")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(sigStr)
+	if err != nil {
+		nonces.release(nonceKey)
+		return nil, fmt.Errorf("malformed sig: %w", err)
+	}
+
+	state := &authState{
+		secret:      secret,
+		method:      r.Method,
+		path:        r.URL.Path,
+		rawQuery:    r.URL.RawQuery,
+		ts:          ts,
+		nonce:       nonce,
+		nonceKey:    nonceKey,
+		providedSig: sig,
+		hasher:      sha256.New(),
+	}
+	r = r.WithContext(context.WithValue(r.Context(), authStateKey{}, state))
+	r.Body = &hashingBody{ReadCloser: r.Body, hasher: state.hasher}
+	return r, nil
+}
+
+// authError distinguishes a failed HMAC signature check from other errors,
+// so callers that verify mid-stream (e.g. after reading an upload) know to
+// report 401 rather than the error code they'd otherwise use.
+type authError struct {
+	reason string
+}
+
+func (e *authError) Error() string {
+	return e.reason
+}
+
+// verifyBody checks the request's HMAC signature now that its body has been
+// fully read (and therefore hashed). Calling it before the body has been
+// drained will fail the signature check, since SHA256(body) won't match yet.
+func verifyBody(r *http.Request) error {
+	state, ok := r.Context().Value(authStateKey{}).(*authState)
+	if !ok {
+		return &authError{"request was not authenticated"}
+	}
+
+	bodyHash := hex.EncodeToString(state.hasher.Sum(nil))
+	msg := strings.Join([]string{state.method, state.path, state.rawQuery, state.ts, state.nonce, bodyHash}, "\n")
+
+	mac := hmac.New(sha256.New, state.secret)
+	mac.Write([]byte(msg))
+	if !hmac.Equal(mac.Sum(nil), state.providedSig) {
+		nonces.release(state.nonceKey)
+		return &authError{"signature mismatch"}
+	}
+
+	return nil
+}
+
+// parseAuthParams parses the "keyid=<id>, ts=<unix>, nonce=<hex>, sig=<b64>"
+// portion of the Authorization header.
+func parseAuthParams(s string) (map[string]string, error) {
+	params := map[string]string{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed Authorization parameter %q", part)
+		}
+		params[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return params, nil
+}
+
+// hashingBody tees every byte read from the underlying body through hasher,
+// so the caller ends up with SHA256(body) once it has read the body to EOF.
+type hashingBody struct {
+	io.ReadCloser
+	hasher hash.Hash
+}
+
+func (b *hashingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.hasher.Write(p[:n])
+	}
+	return n, err
+}
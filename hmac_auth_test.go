@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseAuthParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:  "well formed",
+			input: "keyid=abc, ts=123, nonce=deadbeef, sig=c2lnbmF0dXJl",
+			want:  map[string]string{"keyid": "abc", "ts": "123", "nonce": "deadbeef", "sig": "c2lnbmF0dXJl"},
+		},
+		{
+			name:  "no spaces after commas",
+			input: "keyid=abc,ts=123",
+			want:  map[string]string{"keyid": "abc", "ts": "123"},
+		},
+		{
+			name:  "empty",
+			input: "",
+			want:  map[string]string{},
+		},
+		{
+			name:    "missing equals",
+			input:   "keyid",
+			wantErr: true,
+		},
+		{
+			name:    "missing equals in second param",
+			input:   "keyid=abc, ts",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAuthParams(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseAuthParams(%q) = %v, want error", tt.input, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseAuthParams(%q) unexpected error: %v", tt.input, err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("parseAuthParams(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Fatalf("parseAuthParams(%q)[%q] = %q, want %q", tt.input, k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+// signRequest builds the DPHARMD1 Authorization header value for req/body
+// the same way a correctly behaving client would.
+func signRequest(t *testing.T, secret []byte, method, path, rawQuery, nonce string, body []byte) string {
+	t.Helper()
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	bodyHash := sha256.Sum256(body)
+	msg := strings.Join([]string{method, path, rawQuery, ts, nonce, hex.EncodeToString(bodyHash[:])}, "\n")
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(msg))
+	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return fmt.Sprintf("DPHARMD1 keyid=testkey, ts=%s, nonce=%s, sig=%s", ts, nonce, sig)
+}
+
+func TestAuthenticateAndVerifyBodySuccess(t *testing.T) {
+	secret := []byte("s3kret")
+	setKeyring(map[string][]byte{"testkey": secret})
+
+	body := []byte(`{"hello":"world"}`)
+	req := httptest.NewRequest(http.MethodPost, "/jobs?foo=bar", strings.NewReader(string(body)))
+	req.Header.Set("Authorization", signRequest(t, secret, http.MethodPost, "/jobs", "foo=bar", "nonce-success", body))
+
+	authed, err := authenticate(req)
+	if err != nil {
+		t.Fatalf("authenticate: unexpected error: %v", err)
+	}
+
+	got := make([]byte, len(body))
+	if _, err := authed.Body.Read(got); err != nil && err.Error() != "EOF" {
+		t.Fatalf("reading body: %v", err)
+	}
+
+	if err := verifyBody(authed); err != nil {
+		t.Fatalf("verifyBody: unexpected error: %v", err)
+	}
+}
+
+func TestAuthenticateRejectsTamperedBody(t *testing.T) {
+	secret := []byte("s3kret")
+	setKeyring(map[string][]byte{"testkey": secret})
+
+	signedBody := []byte(`original`)
+	req := httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader("tampered"))
+	req.Header.Set("Authorization", signRequest(t, secret, http.MethodPost, "/jobs", "", "nonce-tamper", signedBody))
+
+	authed, err := authenticate(req)
+	if err != nil {
+		t.Fatalf("authenticate: unexpected error: %v", err)
+	}
+	buf := make([]byte, 64)
+	authed.Body.Read(buf)
+
+	if err := verifyBody(authed); err == nil {
+		t.Fatal("verifyBody accepted a body that doesn't match the signed hash")
+	}
+}
+
+func TestAuthenticateRejectsUnknownKey(t *testing.T) {
+	setKeyring(map[string][]byte{"testkey": []byte("s3kret")})
+
+	req := httptest.NewRequest(http.MethodGet, "/jobs", nil)
+	req.Header.Set("Authorization", "DPHARMD1 keyid=nosuchkey, ts=1, nonce=n, sig=c2ln")
+
+	if _, err := authenticate(req); err == nil {
+		t.Fatal("authenticate accepted an unknown keyid")
+	}
+}
+
+func TestAuthenticateRejectsReplayedNonce(t *testing.T) {
+	secret := []byte("s3kret")
+	setKeyring(map[string][]byte{"testkey": secret})
+
+	body := []byte("payload")
+	mkReq := func(nonce string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(string(body)))
+		req.Header.Set("Authorization", signRequest(t, secret, http.MethodPost, "/jobs", "", nonce, body))
+		return req
+	}
+
+	nonce := "nonce-replay-" + RandomAlphaNumericString(8)
+	first, err := authenticate(mkReq(nonce))
+	if err != nil {
+		t.Fatalf("authenticate: unexpected error on first use: %v", err)
+	}
+	buf := make([]byte, len(body))
+	first.Body.Read(buf)
+	if err := verifyBody(first); err != nil {
+		t.Fatalf("verifyBody: unexpected error: %v", err)
+	}
+
+	if _, err := authenticate(mkReq(nonce)); err == nil {
+		t.Fatal("authenticate accepted a nonce that was already verified")
+	}
+}
+
+func TestVerifyBodyReleasesNonceOnSignatureFailure(t *testing.T) {
+	setKeyring(map[string][]byte{"testkey": []byte("s3kret")})
+
+	nonce := "nonce-unverified-" + RandomAlphaNumericString(8)
+	req := httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader("payload"))
+	// Sign with the wrong secret, so verifyBody will fail the signature check.
+	req.Header.Set("Authorization", signRequest(t, []byte("wrong-secret"), http.MethodPost, "/jobs", "", nonce, []byte("payload")))
+
+	authed, err := authenticate(req)
+	if err != nil {
+		t.Fatalf("authenticate: unexpected error: %v", err)
+	}
+	buf := make([]byte, 64)
+	authed.Body.Read(buf)
+	if err := verifyBody(authed); err == nil {
+		t.Fatal("verifyBody accepted a signature made with the wrong secret")
+	}
+
+	// A failed signature check must release the claim authenticate took on
+	// the nonce, or a client that made a mistake signing its first attempt
+	// could never retry with a corrected signature under the same nonce.
+	if !nonces.claim("testkey:" + nonce) {
+		t.Fatal("nonce was still claimed after its signature failed to verify")
+	}
+}
+
+// TestAuthenticateClaimsNonceAtomically reproduces the TOCTOU race where a
+// replayed request racing the original both reach verifyBody before either
+// has recorded the nonce: firing identically-signed requests concurrently
+// must let exactly one of them claim the nonce in authenticate, not both.
+func TestAuthenticateClaimsNonceAtomically(t *testing.T) {
+	secret := []byte("s3kret")
+	setKeyring(map[string][]byte{"testkey": secret})
+
+	body := []byte("payload")
+	nonce := "nonce-race-" + RandomAlphaNumericString(8)
+	sig := signRequest(t, secret, http.MethodPost, "/jobs", "", nonce, body)
+
+	const attempts = 5
+	results := make(chan error, attempts)
+	for i := 0; i < attempts; i++ {
+		go func() {
+			req := httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(string(body)))
+			req.Header.Set("Authorization", sig)
+			_, err := authenticate(req)
+			results <- err
+		}()
+	}
+
+	successes := 0
+	for i := 0; i < attempts; i++ {
+		if err := <-results; err == nil {
+			successes++
+		}
+	}
+	if successes != 1 {
+		t.Fatalf("got %d concurrent callers accepted for the same nonce, want exactly 1", successes)
+	}
+}
+
+// TestReloadKeyringOnSIGHUP confirms a key added to the keyring file after
+// startup becomes usable once the daemon receives SIGHUP, without a
+// restart.
+func TestReloadKeyringOnSIGHUP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte("oldkey:old-secret\n"), 0600); err != nil {
+		t.Fatalf("writing keyring file: %v", err)
+	}
+	keys, err := loadKeyring(path)
+	if err != nil {
+		t.Fatalf("loadKeyring: %v", err)
+	}
+	setKeyring(keys)
+
+	if _, ok := lookupKey("newkey"); ok {
+		t.Fatal("newkey already present in keyring before it was added")
+	}
+
+	go reloadKeyringOnSIGHUP(path)
+
+	if err := os.WriteFile(path, []byte("oldkey:old-secret\nnewkey:new-secret\n"), 0600); err != nil {
+		t.Fatalf("rewriting keyring file: %v", err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatalf("sending SIGHUP: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if secret, ok := lookupKey("newkey"); ok {
+			if string(secret) != "new-secret" {
+				t.Fatalf("newkey secret = %q, want %q", secret, "new-secret")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("keyring was not reloaded after SIGHUP within 2s")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var stateDir = flag.String("state-dir", filepath.Join(os.TempDir(), "dpharmd-jobs"), "directory used to persist job metadata and logs across restarts")
+
+type jobStatus string
+
+const (
+	jobQueued   jobStatus = "queued"
+	jobRunning  jobStatus = "running"
+	jobPassed   jobStatus = "passed"
+	jobFailed   jobStatus = "failed"
+	jobCanceled jobStatus = "canceled"
+)
+
+// jobRecord is the JSON representation of a job, both for API responses and
+// for the metadata persisted under -state-dir.
+type jobRecord struct {
+	ID         string       `json:"id"`
+	TestType   string       `json:"test_type"`
+	Status     jobStatus    `json:"status"`
+	CreatedAt  time.Time    `json:"created_at"`
+	FinishedAt *time.Time   `json:"finished_at,omitempty"`
+	Summary    *testSummary `json:"summary,omitempty"`
+}
+
+// job is the in-memory, running form of a submitted test request. It may
+// fan out across several devices, each of which is run on its own device
+// queue; the job is done once every device task has reported in.
+type job struct {
+	id       string
+	testType string
+	log      *logBuffer
+
+	mu         sync.Mutex
+	status     jobStatus
+	createdAt  time.Time
+	finishedAt time.Time
+	pending    int
+	results    []deviceResult
+	canceled   bool
+	cmds       map[*exec.Cmd]struct{}
+	cleanup    []string
+}
+
+func (j *job) record() jobRecord {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	rec := jobRecord{ID: j.id, TestType: j.testType, Status: j.status, CreatedAt: j.createdAt}
+	if !j.finishedAt.IsZero() {
+		t := j.finishedAt
+		rec.FinishedAt = &t
+	}
+	if j.status == jobPassed || j.status == jobFailed || j.status == jobCanceled {
+		summary := testSummary{Passed: j.status == jobPassed, Results: append([]deviceResult(nil), j.results...)}
+		rec.Summary = &summary
+	}
+	return rec
+}
+
+// markRunning transitions a queued job to running the first time one of its
+// device tasks actually starts executing.
+func (j *job) markRunning() {
+	j.mu.Lock()
+	if j.status == jobQueued {
+		j.status = jobRunning
+	}
+	j.mu.Unlock()
+}
+
+func (j *job) isCanceled() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.canceled
+}
+
+func (j *job) trackCmd(cmd *exec.Cmd) {
+	j.mu.Lock()
+	j.cmds[cmd] = struct{}{}
+	j.mu.Unlock()
+}
+
+func (j *job) untrackCmd(cmd *exec.Cmd) {
+	j.mu.Lock()
+	delete(j.cmds, cmd)
+	j.mu.Unlock()
+}
+
+// cancel marks the job canceled, preventing not-yet-started device tasks
+// from running, and kills any currently in-flight commands.
+func (j *job) cancel() {
+	j.mu.Lock()
+	j.canceled = true
+	cmds := make([]*exec.Cmd, 0, len(j.cmds))
+	for cmd := range j.cmds {
+		cmds = append(cmds, cmd)
+	}
+	j.mu.Unlock()
+
+	for _, cmd := range cmds {
+		if cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+	}
+}
+
+// recordResult stores one device's outcome and, once every device has
+// reported in, finalizes the job's overall status.
+func (j *job) recordResult(result deviceResult) {
+	j.mu.Lock()
+	j.results = append(j.results, result)
+	j.pending--
+	done := j.pending <= 0
+	if done {
+		// canceled is read here, under the same critical section that
+		// finalizes the status, so a cancel() landing between the two
+		// can't be lost and reported as passed/failed instead.
+		if j.canceled {
+			j.status = jobCanceled
+		} else {
+			j.status = jobPassed
+			for _, res := range j.results {
+				if !res.Passed {
+					j.status = jobFailed
+					break
+				}
+			}
+		}
+		j.finishedAt = time.Now()
+	}
+	j.mu.Unlock()
+
+	if !done {
+		return
+	}
+
+	j.log.Close()
+	for _, path := range j.cleanup {
+		os.RemoveAll(path)
+	}
+	jobMgr.persist(j)
+}
+
+// runLoggedCommand runs cmd, streaming its combined stdout/stderr into the
+// job's log in real time (rather than buffering it all via
+// cmd.CombinedOutput), and registers the process so DELETE /jobs/{id} can
+// kill it mid-flight. It returns the captured combined output.
+func runLoggedCommand(j *job, name string, args ...string) (string, error) {
+	return runLoggedCommandDir(j, "", name, args...)
+}
+
+// runLoggedCommandDir is runLoggedCommand with an explicit working
+// directory, so concurrently running jobs don't race over the process-wide
+// cwd the way a shared os.Chdir would.
+func runLoggedCommandDir(j *job, dir, name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	var buf bytes.Buffer
+	out := io.MultiWriter(j.log, &buf)
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	j.trackCmd(cmd)
+	err := cmd.Wait()
+	j.untrackCmd(cmd)
+	return buf.String(), err
+}
+
+// deviceQueue is a bounded, single-worker task queue for one device/
+// simulator, so test runs targeting the same device still serialize while
+// disjoint devices run concurrently and submitters never block on it.
+type deviceQueue struct {
+	tasks chan func()
+}
+
+func newDeviceQueue() *deviceQueue {
+	q := &deviceQueue{tasks: make(chan func(), 64)}
+	go q.run()
+	return q
+}
+
+func (q *deviceQueue) run() {
+	for task := range q.tasks {
+		task()
+	}
+}
+
+func (q *deviceQueue) submit(task func()) {
+	q.tasks <- task
+}
+
+// jobManager tracks in-flight jobs and the per-device queues that run them,
+// and persists job metadata/logs under stateDir so clients can reconnect
+// after a daemon restart.
+type jobManager struct {
+	stateDir string
+
+	mu     sync.Mutex
+	jobs   map[string]*job
+	queues map[string]*deviceQueue
+}
+
+var jobMgr *jobManager
+
+func newJobManager(dir string) *jobManager {
+	return &jobManager{stateDir: dir, jobs: map[string]*job{}, queues: map[string]*deviceQueue{}}
+}
+
+func (m *jobManager) queueFor(device string) *deviceQueue {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q, ok := m.queues[device]
+	if !ok {
+		q = newDeviceQueue()
+		m.queues[device] = q
+	}
+	return q
+}
+
+// newJob creates and registers a job expected to run across len(devices)
+// device tasks.
+func (m *jobManager) newJob(testType string, numDevices int, cleanup ...string) (*job, error) {
+	if err := os.MkdirAll(m.stateDir, 0700); err != nil {
+		return nil, err
+	}
+
+	id := RandomAlphaNumericString(12)
+	logPath := filepath.Join(m.stateDir, id+".log")
+	lb, err := newLogBuffer(logPath)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &job{
+		id:        id,
+		testType:  testType,
+		log:       lb,
+		status:    jobQueued,
+		createdAt: time.Now(),
+		pending:   numDevices,
+		cmds:      map[*exec.Cmd]struct{}{},
+		cleanup:   cleanup,
+	}
+
+	m.mu.Lock()
+	m.jobs[id] = j
+	m.mu.Unlock()
+
+	m.persist(j)
+	return j, nil
+}
+
+func (m *jobManager) get(id string) (*job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	return j, ok
+}
+
+func (m *jobManager) metadataPath(id string) string {
+	return filepath.Join(m.stateDir, id+".json")
+}
+
+func (m *jobManager) logPath(id string) string {
+	return filepath.Join(m.stateDir, id+".log")
+}
+
+func (m *jobManager) persist(j *job) {
+	rec := j.record()
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		log.Printf("job %s: failed to marshal metadata: %v", j.id, err)
+		return
+	}
+	if err := os.WriteFile(m.metadataPath(j.id), data, 0600); err != nil {
+		log.Printf("job %s: failed to persist metadata: %v", j.id, err)
+	}
+}
+
+// recordFor returns the jobRecord for id, preferring the live in-memory job
+// (so a running job's status reflects reality) and falling back to the
+// metadata persisted on disk for jobs from a previous daemon run.
+func (m *jobManager) recordFor(id string) (jobRecord, bool) {
+	if j, ok := m.get(id); ok {
+		return j.record(), true
+	}
+
+	data, err := os.ReadFile(m.metadataPath(id))
+	if err != nil {
+		return jobRecord{}, false
+	}
+	var rec jobRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return jobRecord{}, false
+	}
+	return rec, true
+}
+
+// loadPersisted scans stateDir on startup so historical jobs can still be
+// queried after a restart. Any job that was still queued/running when the
+// daemon stopped is marked failed, since its process no longer exists.
+func (m *jobManager) loadPersisted() {
+	entries, err := os.ReadDir(m.stateDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(m.stateDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var rec jobRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			continue
+		}
+		if rec.Status == jobQueued || rec.Status == jobRunning {
+			rec.Status = jobFailed
+			now := time.Now()
+			rec.FinishedAt = &now
+			if data, err := json.MarshalIndent(rec, "", "  "); err == nil {
+				os.WriteFile(filepath.Join(m.stateDir, entry.Name()), data, 0600)
+			}
+		}
+	}
+}
+
+func fmtJobNotFound(id string) error {
+	return fmt.Errorf("no such job %q", id)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestJobManager returns a jobManager backed by a temp state dir and
+// installs it as the package-level jobMgr, since job.recordResult persists
+// through that global rather than a manager reference threaded to job.
+func newTestJobManager(t *testing.T) *jobManager {
+	t.Helper()
+	orig := jobMgr
+	t.Cleanup(func() { jobMgr = orig })
+	m := newJobManager(filepath.Join(t.TempDir(), "jobs"))
+	jobMgr = m
+	return m
+}
+
+// TestJobCancelSkipsQueuedDeviceTasks mirrors the submitAndroidJob/
+// submitIOSJob closure: each queued device task checks isCanceled() before
+// doing any real work. A job canceled before a device's task is dequeued
+// must have that device report "job canceled" instead of running.
+func TestJobCancelSkipsQueuedDeviceTasks(t *testing.T) {
+	m := newTestJobManager(t)
+	devices := []string{"device-a", "device-b"}
+	j, err := m.newJob(testTypeAndroid, len(devices))
+	if err != nil {
+		t.Fatalf("newJob: %v", err)
+	}
+
+	j.cancel()
+
+	var executed int32
+	var wg sync.WaitGroup
+	for _, device := range devices {
+		device := device
+		wg.Add(1)
+		m.queueFor(device).submit(func() {
+			defer wg.Done()
+			var result deviceResult
+			if j.isCanceled() {
+				result = deviceResult{Device: device, Passed: false, Error: "job canceled"}
+			} else {
+				executed++
+				result = deviceResult{Device: device, Passed: true}
+			}
+			j.recordResult(result)
+		})
+	}
+	wg.Wait()
+
+	if executed != 0 {
+		t.Fatalf("executed = %d, want 0: a task queued after cancel() must not run", executed)
+	}
+	rec := j.record()
+	if rec.Status != jobCanceled {
+		t.Fatalf("job status = %q, want %q", rec.Status, jobCanceled)
+	}
+	for _, res := range rec.Summary.Results {
+		if res.Error != "job canceled" {
+			t.Fatalf("device %s result = %+v, want job canceled error", res.Device, res)
+		}
+	}
+}
+
+// TestJobCancelKillsTrackedCmd exercises the one race cancel() does cover:
+// a command already registered via trackCmd when cancel() runs is killed.
+func TestJobCancelKillsTrackedCmd(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a unix sleep command")
+	}
+	m := newTestJobManager(t)
+	j, err := m.newJob(testTypeAndroid, 1)
+	if err != nil {
+		t.Fatalf("newJob: %v", err)
+	}
+
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("starting sleep: %v", err)
+	}
+	j.trackCmd(cmd)
+
+	j.cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("tracked command was not killed by cancel()")
+	}
+}
+
+// TestRecordResultCancelRace finalizes a job as canceled even when cancel()
+// lands concurrently with the last device's recordResult, since both read
+// j.canceled under the same lock that sets the terminal status.
+func TestRecordResultCancelRace(t *testing.T) {
+	m := newTestJobManager(t)
+	j, err := m.newJob(testTypeAndroid, 1)
+	if err != nil {
+		t.Fatalf("newJob: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		j.cancel()
+	}()
+	go func() {
+		defer wg.Done()
+		j.recordResult(deviceResult{Device: "device-a", Passed: true})
+	}()
+	wg.Wait()
+
+	rec := j.record()
+	if rec.Status != jobCanceled && rec.Status != jobPassed {
+		t.Fatalf("job status = %q, want canceled or passed", rec.Status)
+	}
+}
+
+func TestDeviceQueueSerializesPerDevice(t *testing.T) {
+	q := newDeviceQueue()
+	var mu sync.Mutex
+	var running, maxRunning int
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		q.submit(func() {
+			defer wg.Done()
+			mu.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			mu.Lock()
+			running--
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+
+	if maxRunning != 1 {
+		t.Fatalf("max concurrently running tasks on one device queue = %d, want 1", maxRunning)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+)
+
+// junitTestSuites is the root element CI systems expect from a JUnit XML
+// report, one <testsuite> per device/destination the job ran against.
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Errors    int             `xml:"errors,attr"`
+	Testcases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr,omitempty"`
+	Name      string        `xml:"name,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Error     *junitFailure `xml:"error,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// writeJUnit renders a jobRecord's per-device results as JUnit XML. Jobs
+// with no structured per-test results (e.g. ones that failed before any
+// test ran) get a single synthetic testcase per device summarizing its
+// pass/fail outcome, so the report always reflects every device that ran.
+func writeJUnit(w io.Writer, rec jobRecord) error {
+	doc := junitTestSuites{}
+	if rec.Summary != nil {
+		for _, res := range rec.Summary.Results {
+			suite := junitTestSuite{Name: res.Device}
+			if len(res.Tests) == 0 {
+				tc := junitTestCase{Name: res.Device}
+				if !res.Passed {
+					tc.Failure = &junitFailure{Message: res.Error, Body: res.Output}
+					suite.Failures++
+				}
+				suite.Testcases = append(suite.Testcases, tc)
+				suite.Tests++
+			} else {
+				for _, t := range res.Tests {
+					tc := junitTestCase{ClassName: t.ClassName, Name: t.Name}
+					switch t.Status {
+					case testStatusFailed:
+						tc.Failure = &junitFailure{Message: t.Message}
+						suite.Failures++
+					case testStatusError:
+						tc.Error = &junitFailure{Message: t.Message}
+						suite.Errors++
+					}
+					suite.Testcases = append(suite.Testcases, tc)
+					suite.Tests++
+				}
+			}
+			doc.Suites = append(doc.Suites, suite)
+		}
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(doc)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestWriteJUnit(t *testing.T) {
+	rec := jobRecord{
+		ID:     "job-1",
+		Status: jobFailed,
+		Summary: &testSummary{
+			Passed: false,
+			Results: []deviceResult{
+				{
+					Device: "emulator-5554",
+					Passed: false,
+					Tests: []testCaseResult{
+						{ClassName: "com.foo.BarTest", Name: "testOne", Status: testStatusPassed},
+						{ClassName: "com.foo.BarTest", Name: "testTwo", Status: testStatusFailed, Message: "expected true"},
+						{ClassName: "com.foo.BarTest", Name: "testThree", Status: testStatusError, Message: "boom"},
+					},
+				},
+				{
+					Device: "destination-without-tests",
+					Passed: false,
+					Error:  "xcodebuild: exit status 1",
+					Output: "build failed",
+				},
+			},
+		},
+	}
+
+	var buf strings.Builder
+	if err := writeJUnit(&buf, rec); err != nil {
+		t.Fatalf("writeJUnit: unexpected error: %v", err)
+	}
+
+	var doc junitTestSuites
+	if err := xml.Unmarshal([]byte(buf.String()), &doc); err != nil {
+		t.Fatalf("writeJUnit produced invalid XML: %v\n%s", err, buf.String())
+	}
+
+	if len(doc.Suites) != 2 {
+		t.Fatalf("got %d suites, want 2", len(doc.Suites))
+	}
+
+	withTests := doc.Suites[0]
+	if withTests.Name != "emulator-5554" || withTests.Tests != 3 || withTests.Failures != 1 || withTests.Errors != 1 {
+		t.Fatalf("suite with structured tests = %+v", withTests)
+	}
+
+	synthesized := doc.Suites[1]
+	if synthesized.Tests != 1 || synthesized.Failures != 1 {
+		t.Fatalf("suite with no structured tests should get one synthetic failing testcase, got %+v", synthesized)
+	}
+	if got := synthesized.Testcases[0].Failure.Message; got != "xcodebuild: exit status 1" {
+		t.Fatalf("synthetic testcase failure message = %q, want device error", got)
+	}
+}
+
+func TestWriteJUnitNoSummary(t *testing.T) {
+	var buf strings.Builder
+	if err := writeJUnit(&buf, jobRecord{ID: "job-1", Status: jobQueued}); err != nil {
+		t.Fatalf("writeJUnit: unexpected error: %v", err)
+	}
+
+	var doc junitTestSuites
+	if err := xml.Unmarshal([]byte(buf.String()), &doc); err != nil {
+		t.Fatalf("writeJUnit produced invalid XML: %v\n%s", err, buf.String())
+	}
+	if len(doc.Suites) != 0 {
+		t.Fatalf("got %d suites for a job with no summary, want 0", len(doc.Suites))
+	}
+}
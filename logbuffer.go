@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// logBuffer is an append-only, disk-backed log for a single job. Writes are
+// persisted immediately so GET /jobs/{id}/logs can serve them after a
+// restart, and followers blocked in follow() are woken via a condition
+// variable as soon as new bytes land.
+type logBuffer struct {
+	path string
+	file *os.File
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	size   int64
+	closed bool
+}
+
+func newLogBuffer(path string) (*logBuffer, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	lb := &logBuffer{path: path, file: f}
+	lb.cond = sync.NewCond(&lb.mu)
+	return lb, nil
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n, err := b.file.Write(p)
+	b.size += int64(n)
+	b.cond.Broadcast()
+	return n, err
+}
+
+// Close marks the log done and wakes any followers so they can return once
+// they've drained the remaining bytes.
+func (b *logBuffer) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.cond.Broadcast()
+	b.mu.Unlock()
+	return b.file.Close()
+}
+
+// follow writes the log's full contents to w, then continues tailing new
+// writes in real time until the log is closed (the job finished) or stop
+// fires (the client disconnected). flush is called after each write so
+// callers streaming over HTTP can push bytes out immediately.
+func (b *logBuffer) follow(w io.Writer, flush func(), stop <-chan struct{}) error {
+	f, err := os.Open(b.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Wake the condition wait if the caller's context is canceled.
+	giveUp := make(chan struct{})
+	defer close(giveUp)
+	go func() {
+		select {
+		case <-stop:
+			b.mu.Lock()
+			b.cond.Broadcast()
+			b.mu.Unlock()
+		case <-giveUp:
+		}
+	}()
+
+	var offset int64
+	for {
+		b.mu.Lock()
+		for b.size == offset && !b.closed {
+			select {
+			case <-stop:
+				b.mu.Unlock()
+				return nil
+			default:
+			}
+			b.cond.Wait()
+		}
+		size, closed := b.size, b.closed
+		b.mu.Unlock()
+
+		if size > offset {
+			n, err := io.CopyN(w, f, size-offset)
+			offset += n
+			if err != nil {
+				return err
+			}
+			flush()
+		}
+
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		if closed && offset >= size {
+			return nil
+		}
+	}
+}
+
+// readLogFile returns the log's full contents read from disk, for one-shot
+// (non-follow) reads and for historical jobs with no in-memory logBuffer.
+func readLogFile(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
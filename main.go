@@ -3,10 +3,10 @@ package main
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"math/big"
 	"net/http"
@@ -15,29 +15,74 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
-	"sync"
 )
 
-var secret = flag.String("secret", "", "request secret")
-var testMu sync.Mutex
+var adbPath = flag.String("adb", "adb", "path to the adb binary")
+var androidDevicesFlag = flag.String("devices", "", "comma-separated adb -s device/emulator IDs available for Android testing")
+var simulatorsFlag = flag.String("simulators", "", "comma-separated iOS simulator destinations available for testing")
+var tlsCert = flag.String("tls-cert", "", "TLS certificate file; serves HTTPS when set together with -tls-key")
+var tlsKey = flag.String("tls-key", "", "TLS private key file; serves HTTPS when set together with -tls-cert")
+
+var androidDevices []string
+var iosSimulators []string
 
 func main() {
 	flag.Parse()
 
-	if *secret == "" {
+	if *keysFile == "" {
 		flag.Usage()
 		os.Exit(1)
 	}
+	keys, err := loadKeyring(*keysFile)
+	if err != nil {
+		log.Fatalf("loading keyring %q: %v", *keysFile, err)
+	}
+	setKeyring(keys)
+	go reloadKeyringOnSIGHUP(*keysFile)
+
+	androidDevices = splitCSV(*androidDevicesFlag)
+	iosSimulators = splitCSV(*simulatorsFlag)
+
+	jobMgr = newJobManager(*stateDir)
+	jobMgr.loadPersisted()
+
+	go runUploadReaper()
 
-	if err := http.ListenAndServe(":8080", http.HandlerFunc(handler)); err != nil {
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("-tls-cert and -tls-key must be set together")
+	}
+	if *tlsCert != "" {
+		err = http.ListenAndServeTLS(":8080", *tlsCert, *tlsKey, http.HandlerFunc(handler))
+	} else {
+		err = http.ListenAndServe(":8080", http.HandlerFunc(handler))
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
 }
 
+func splitCSV(s string) []string {
+	if s == "" {
+		return nil
+	}
+	parts := strings.Split(s, ",")
+	out := make([]string, 0, len(parts))
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+const jobsPrefix = "/jobs/"
+
 func handler(w http.ResponseWriter, r *http.Request) {
-	auth := r.Header.Get("Authorization")
-	if auth != *secret {
+	r, err := authenticate(r)
+	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(err.Error()))
 		return
 	}
 
@@ -47,20 +92,203 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(err.Error()))
 		return
 	}
+
+	// POST /tests streams an upload through its handler; the signature is
+	// verified there, once the body (folded into it) has been read.
+	if r.Method == http.MethodPost && r.URL.Path == "/tests" {
+		submitTestJob(w, r, query)
+		return
+	}
+
+	// Every other route has no meaningful body, so the signature can be
+	// verified immediately after draining it.
+	io.Copy(io.Discard, r.Body)
+	if err := verifyBody(r); err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, jobsPrefix) {
+		id := strings.TrimPrefix(r.URL.Path, jobsPrefix)
+		if logsID, ok := strings.CutSuffix(id, "/logs"); ok {
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			streamJobLogs(w, r, logsID, query.Get("follow") == "1")
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			getJobStatus(w, id, query.Get("format"))
+		case http.MethodDelete:
+			cancelJobHandler(w, id)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte("must POST /tests?test_type=... or GET/DELETE /jobs/{id}"))
+}
+
+func submitTestJob(w http.ResponseWriter, r *http.Request, query url.Values) {
 	switch query.Get("test_type") {
 	case testTypeAndroid:
-		runAndroidTest(w, r, query)
-		return
+		submitAndroidJob(w, r, query)
 	case testTypeIOS:
-		runIOSTest(w, r, query)
+		submitIOSJob(w, r, query)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("must specify 'test_type'"))
+	}
+}
+
+func getJobStatus(w http.ResponseWriter, id, format string) {
+	rec, ok := jobMgr.recordFor(id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmtJobNotFound(id).Error()))
 		return
 	}
 
-	w.WriteHeader(http.StatusBadRequest)
-	w.Write([]byte("must specify 'test_type'"))
+	if format == "junit" {
+		w.Header().Set("Content-Type", "application/xml")
+		if err := writeJUnit(w, rec); err != nil {
+			log.Printf("failed to encode job record as junit: %v", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rec); err != nil {
+		log.Printf("failed to encode job record: %v", err)
+	}
+}
+
+func cancelJobHandler(w http.ResponseWriter, id string) {
+	j, ok := jobMgr.get(id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmtJobNotFound(id).Error()))
+		return
+	}
+	j.mu.Lock()
+	terminal := j.status == jobPassed || j.status == jobFailed || j.status == jobCanceled
+	j.mu.Unlock()
+	if terminal {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("job has already finished"))
+		return
+	}
+
+	j.cancel()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func streamJobLogs(w http.ResponseWriter, r *http.Request, id string, follow bool) {
+	j, live := jobMgr.get(id)
+
+	var logPath string
+	if live {
+		logPath = jobMgr.logPath(id)
+	} else {
+		logPath = jobMgr.logPath(id)
+		if _, err := os.Stat(logPath); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(fmtJobNotFound(id).Error()))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if !live || !follow {
+		data, err := readLogFile(logPath)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.Write(data)
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if err := j.log.follow(w, flush, r.Context().Done()); err != nil {
+		log.Printf("job %s: log follow ended: %v", id, err)
+	}
+}
+
+const (
+	testTypeAndroid = "android"
+	testTypeIOS     = "ios"
+)
+
+// deviceResult is the outcome of running a test against a single Android
+// device/emulator or iOS simulator destination.
+type deviceResult struct {
+	Device string           `json:"device"`
+	Passed bool             `json:"passed"`
+	Output string           `json:"output"`
+	Error  string           `json:"error,omitempty"`
+	Tests  []testCaseResult `json:"tests,omitempty"`
+}
+
+// testSummary aggregates per-device results for a single test request.
+type testSummary struct {
+	Passed  bool           `json:"passed"`
+	Results []deviceResult `json:"results"`
+}
+
+// androidTargets resolves which devices a request should run against, honoring
+// the device_ids and abi query params, and falling back to the full -devices
+// pool (or the legacy unspecified adb device if none was configured).
+func androidTargets(query url.Values) ([]string, error) {
+	devices := androidDevices
+	if ids := query.Get("device_ids"); ids != "" {
+		devices = splitCSV(ids)
+	}
+	if len(devices) == 0 {
+		devices = []string{""}
+	}
+
+	if abi := query.Get("abi"); abi != "" {
+		var filtered []string
+		for _, id := range devices {
+			if id == "" {
+				continue
+			}
+			deviceABI, err := androidDeviceABI(id)
+			if err != nil {
+				return nil, fmt.Errorf("querying abi for device %q: %w", id, err)
+			}
+			if deviceABI == abi {
+				filtered = append(filtered, id)
+			}
+		}
+		devices = filtered
+	}
+
+	return devices, nil
 }
 
-func runAndroidTest(w http.ResponseWriter, r *http.Request, query url.Values) {
+func androidDeviceABI(id string) (string, error) {
+	out, err := exec.Command(*adbPath, "-s", id, "shell", "getprop", "ro.product.cpu.abi").Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func submitAndroidJob(w http.ResponseWriter, r *http.Request, query url.Values) {
 	testPackage := query.Get("test_package")
 	if testPackage == "" {
 		w.WriteHeader(http.StatusBadRequest)
@@ -68,6 +296,26 @@ func runAndroidTest(w http.ResponseWriter, r *http.Request, query url.Values) {
 		return
 	}
 
+	devices, err := androidTargets(query)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if len(devices) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("no devices matched the request"))
+		return
+	}
+
+	runner := androidRunner(query)
+	filterArgs, err := androidFilterArgs(query)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
 	dir := os.TempDir()
 	apkFileName := filepath.Join(dir, fmt.Sprintf("test_%s.apk", RandomAlphaNumericString(5)))
 	apkFile, err := os.OpenFile(apkFileName, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
@@ -76,50 +324,114 @@ func runAndroidTest(w http.ResponseWriter, r *http.Request, query url.Values) {
 		w.Write([]byte(err.Error()))
 		return
 	}
-	defer os.Remove(apkFile.Name())
 
-	reader := io.TeeReader(r.Body, apkFile)
-	if _, err := ioutil.ReadAll(reader); err != nil {
+	digest, err := streamToFileWithDigest(r.Body, apkFile)
+	apkFile.Close()
+	if err != nil {
+		os.Remove(apkFileName)
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
 		return
 	}
-	apkFile.Close()
-
-	log.Printf("android: Installing and running %s", testPackage)
 
-	testMu.Lock()
-	defer testMu.Unlock()
+	if err := verifyBody(r); err != nil {
+		os.Remove(apkFileName)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(err.Error()))
+		return
+	}
 
-	cmd := exec.Command("adb", "install", "-r", apkFile.Name())
-	result, err := cmd.CombinedOutput()
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	if err := checkArtifactDigest(r, digest); err != nil {
+		os.Remove(apkFileName)
+		w.WriteHeader(http.StatusUnprocessableEntity)
 		w.Write([]byte(err.Error()))
-		w.Write([]byte("\n"))
-		w.Write(result)
 		return
 	}
 
-	testPackageWithRunner := fmt.Sprintf("%s/android.support.test.runner.AndroidJUnitRunner", testPackage)
-	cmd = exec.Command("adb", "shell", "am", "instrument", "-w", testPackageWithRunner)
-	result, err = cmd.CombinedOutput()
+	j, err := jobMgr.newJob(testTypeAndroid, len(devices), apkFileName)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		os.Remove(apkFileName)
+		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
-		w.Write([]byte("\n"))
-		w.Write(result)
 		return
 	}
 
-	w.Write(result)
+	log.Printf("android: job %s installing and running %s on %d device(s)", j.id, testPackage, len(devices))
+
+	for _, device := range devices {
+		device := device
+		jobMgr.queueFor(device).submit(func() {
+			// A cancel() landing between this check and the adb command
+			// actually being tracked (runAndroidTestOnDevice -> trackCmd)
+			// is not observed here: cancel() only kills commands already
+			// in j.cmds, so this device's run would complete untracked and
+			// unkillable despite the DELETE having already returned 202.
+			var result deviceResult
+			if j.isCanceled() {
+				result = deviceResult{Device: device, Passed: false, Error: "job canceled"}
+			} else {
+				j.markRunning()
+				result = runAndroidTestOnDevice(j, device, testPackage, apkFileName, runner, filterArgs)
+			}
+			j.recordResult(result)
+		})
+	}
+
+	writeJobAccepted(w, j)
+}
+
+func runAndroidTestOnDevice(j *job, device, testPackage, apkPath, runner string, filterArgs []string) deviceResult {
+	adbArgs := func(args ...string) []string {
+		if device == "" {
+			return args
+		}
+		return append([]string{"-s", device}, args...)
+	}
+
+	out, err := runLoggedCommand(j, *adbPath, adbArgs("install", "-r", apkPath)...)
+	if err != nil {
+		return deviceResult{Device: device, Passed: false, Output: out, Error: err.Error()}
+	}
+
+	testPackageWithRunner := fmt.Sprintf("%s/%s", testPackage, runner)
+	instrumentArgs := append(append([]string{"shell", "am", "instrument", "-r", "-w"}, filterArgs...), testPackageWithRunner)
+	out, err = runLoggedCommand(j, *adbPath, adbArgs(instrumentArgs...)...)
+	tests := parseInstrumentationOutput(out)
+	if err != nil {
+		return deviceResult{Device: device, Passed: false, Output: out, Error: err.Error(), Tests: tests}
+	}
+
+	passed := true
+	for _, t := range tests {
+		if t.Status != testStatusPassed && t.Status != testStatusSkipped {
+			passed = false
+			break
+		}
+	}
+	return deviceResult{Device: device, Passed: passed, Output: out, Tests: tests}
 }
 
-func runIOSTest(w http.ResponseWriter, r *http.Request, query url.Values) {
-	testDestination := query.Get("test_destination")
-	if testDestination == "" {
+// iosTargets resolves which simulator destinations a request should run
+// against, honoring the destinations query param and falling back to the
+// full -simulators pool (or the legacy single test_destination otherwise).
+func iosTargets(query url.Values) []string {
+	if destinations := query.Get("destinations"); destinations != "" {
+		return splitCSV(destinations)
+	}
+	if len(iosSimulators) > 0 {
+		return iosSimulators
+	}
+	if dest := query.Get("test_destination"); dest != "" {
+		return []string{dest}
+	}
+	return nil
+}
+
+func submitIOSJob(w http.ResponseWriter, r *http.Request, query url.Values) {
+	destinations := iosTargets(query)
+	if len(destinations) == 0 {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("must specify 'test_destination'"))
+		w.Write([]byte("must specify 'test_destination' or 'destinations'"))
 		return
 	}
 
@@ -130,89 +442,133 @@ func runIOSTest(w http.ResponseWriter, r *http.Request, query url.Values) {
 		return
 	}
 	testSchemes := strings.Split(testSchemesStr, ",")
+	testingArgs := iosTestingArgs(query)
 
-	dir := os.TempDir()
-	if err := os.Chdir(dir); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	uploadedSource, done, progress, err := receiveIOSSource(r, query)
+	if err != nil {
+		if _, ok := err.(*authError); ok {
+			w.WriteHeader(http.StatusUnauthorized)
+		} else {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		}
 		w.Write([]byte(err.Error()))
 		return
 	}
-
-	sourceDir := RandomAlphaNumericString(5)
-	if err := os.Mkdir(sourceDir, 0755); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+	if !done {
+		// A non-final resumable chunk was accepted.
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "received %d of %d bytes\n", progress.Received, progress.Total)
 		return
 	}
-	defer os.RemoveAll(sourceDir)
 
-	if err := os.Chdir(filepath.Join(dir, sourceDir)); err != nil {
+	dir := os.TempDir()
+	sourceDir := filepath.Join(dir, RandomAlphaNumericString(5))
+	if err := os.Mkdir(sourceDir, 0755); err != nil {
+		os.Remove(uploadedSource)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
 
-	sourceFileName := filepath.Join(dir, sourceDir, "source.tgz")
-	sourceFile, err := os.OpenFile(sourceFileName, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
-	if os.IsExist(err) {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
-		return
-	}
+	log.Print("ios: Unpacking source")
 
-	reader := io.TeeReader(r.Body, sourceFile)
-	if _, err := ioutil.ReadAll(reader); err != nil {
+	if err := extractTarGz(uploadedSource, sourceDir); err != nil {
+		os.Remove(uploadedSource)
+		os.RemoveAll(sourceDir)
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
 		return
 	}
-	sourceFile.Close()
-
-	log.Print("ios: Unpacking source")
+	os.Remove(uploadedSource)
 
-	cmd := exec.Command("tar", "xf", sourceFile.Name())
-	result, err := cmd.CombinedOutput()
+	j, err := jobMgr.newJob(testTypeIOS, len(destinations), sourceDir)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		os.RemoveAll(sourceDir)
+		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
-		w.Write([]byte("\n"))
-		w.Write(result)
 		return
 	}
 
-	testMu.Lock()
-	defer testMu.Unlock()
+	log.Printf("ios: job %s testing %d scheme(s) across %d destination(s)", j.id, len(testSchemes), len(destinations))
+
+	for _, destination := range destinations {
+		destination := destination
+		jobMgr.queueFor(destination).submit(func() {
+			// See the equivalent comment in submitAndroidJob: a cancel()
+			// landing here before runIOSTestOnDestination's xcodebuild is
+			// tracked is not observed, so this destination still runs to
+			// completion untracked and unkillable.
+			var result deviceResult
+			if j.isCanceled() {
+				result = deviceResult{Device: destination, Passed: false, Error: "job canceled"}
+			} else {
+				j.markRunning()
+				result = runIOSTestOnDestination(j, sourceDir, destination, testSchemes, testingArgs)
+			}
+			j.recordResult(result)
+		})
+	}
+
+	writeJobAccepted(w, j)
+}
 
-	var testFailed bool
+// runIOSTestOnDestination runs testSchemes against one destination. Each
+// destination gets its own -derivedDataPath: destinations run concurrently
+// on distinct device queues, and xcodebuild's default DerivedData location
+// is keyed off the project alone, so sharing it across concurrent runs
+// against the same checkout would let them corrupt each other's build
+// intermediates.
+func runIOSTestOnDestination(j *job, sourceDir, destination string, testSchemes, testingArgs []string) deviceResult {
+	derivedDataPath := filepath.Join(sourceDir, "DerivedData-"+RandomAlphaNumericString(5))
+
+	var output bytes.Buffer
+	var tests []testCaseResult
+	passed := true
 	for _, scheme := range testSchemes {
-		testStartMsg := fmt.Sprintf("ios: Testing scheme %q on destination %q", scheme, testDestination)
+		testStartMsg := fmt.Sprintf("ios: Testing scheme %q on destination %q", scheme, destination)
 		log.Print(testStartMsg)
-		w.Write([]byte(testStartMsg))
-		w.Write([]byte("\n"))
-		cmd = exec.Command("xcodebuild", "test", "-destination", testDestination, "-scheme", scheme)
-		result, err = cmd.CombinedOutput()
+		j.log.Write([]byte(testStartMsg + "\n"))
+		output.WriteString(testStartMsg)
+		output.WriteString("\n")
+
+		resultBundlePath := filepath.Join(sourceDir, fmt.Sprintf("%s-%s.xcresult", scheme, RandomAlphaNumericString(5)))
+		args := append([]string{"test", "-destination", destination, "-scheme", scheme, "-resultBundlePath", resultBundlePath, "-derivedDataPath", derivedDataPath}, testingArgs...)
+		out, err := runLoggedCommandDir(j, sourceDir, "xcodebuild", args...)
+
+		if schemeTests, parseErr := xcresultTestCases(resultBundlePath); parseErr == nil {
+			tests = append(tests, schemeTests...)
+		} else {
+			log.Printf("ios: failed to parse xcresult for scheme %q: %v", scheme, parseErr)
+		}
+
 		if err != nil {
-			testFailed = true
-			w.Write([]byte("!!TEST FAILED!!\n"))
-			w.Write([]byte(err.Error()))
-			w.Write([]byte("\n"))
-			w.Write(result)
+			passed = false
+			output.WriteString("!!TEST FAILED!!\n")
+			output.WriteString(err.Error())
+			output.WriteString("\n")
+			output.WriteString(out)
 			continue
 		}
 
-		w.Write([]byte("!!TEST PASSED!!\n"))
-		w.Write(result)
+		output.WriteString("!!TEST PASSED!!\n")
+		output.WriteString(out)
 	}
 
-	if !testFailed {
-		w.Write([]byte("!!ALL TESTS PASSED!!\n"))
+	for _, t := range tests {
+		if t.Status != testStatusPassed && t.Status != testStatusSkipped {
+			passed = false
+			break
+		}
 	}
+
+	return deviceResult{Device: destination, Passed: passed, Output: output.String(), Tests: tests}
 }
 
-const (
-	testTypeAndroid = "android"
-	testTypeIOS     = "ios"
-)
+func writeJobAccepted(w http.ResponseWriter, j *job) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"job_id": j.id})
+}
 
 // RandomAlphaNumericString generates a new random alphanumeric key
 func RandomAlphaNumericString(length int) string {
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestAndroidTargets(t *testing.T) {
+	origDevices := androidDevices
+	defer func() { androidDevices = origDevices }()
+
+	tests := []struct {
+		name    string
+		pool    []string
+		query   url.Values
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "device_ids overrides the configured pool",
+			pool:  []string{"pool-1", "pool-2"},
+			query: url.Values{"device_ids": {"requested-1,requested-2"}},
+			want:  []string{"requested-1", "requested-2"},
+		},
+		{
+			name:  "falls back to the configured pool",
+			pool:  []string{"pool-1", "pool-2"},
+			query: url.Values{},
+			want:  []string{"pool-1", "pool-2"},
+		},
+		{
+			name:  "falls back to the legacy unspecified device when no pool is configured",
+			pool:  nil,
+			query: url.Values{},
+			want:  []string{""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			androidDevices = tt.pool
+			got, err := androidTargets(tt.query)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("androidTargets() = %v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("androidTargets() unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("androidTargets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIOSTargets(t *testing.T) {
+	origSimulators := iosSimulators
+	defer func() { iosSimulators = origSimulators }()
+
+	tests := []struct {
+		name       string
+		simulators []string
+		query      url.Values
+		want       []string
+	}{
+		{
+			name:       "destinations overrides the configured pool",
+			simulators: []string{"pool-sim-1"},
+			query:      url.Values{"destinations": {"requested-1,requested-2"}},
+			want:       []string{"requested-1", "requested-2"},
+		},
+		{
+			name:       "falls back to the configured pool",
+			simulators: []string{"pool-sim-1", "pool-sim-2"},
+			query:      url.Values{},
+			want:       []string{"pool-sim-1", "pool-sim-2"},
+		},
+		{
+			name:       "falls back to the legacy single test_destination",
+			simulators: nil,
+			query:      url.Values{"test_destination": {"legacy-dest"}},
+			want:       []string{"legacy-dest"},
+		},
+		{
+			name:       "nil when nothing is specified or configured",
+			simulators: nil,
+			query:      url.Values{},
+			want:       nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iosSimulators = tt.simulators
+			got := iosTargets(tt.query)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("iosTargets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
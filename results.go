@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// testCaseResult is one test method's outcome, parsed from either an Android
+// "am instrument -r -w" status stream or an iOS .xcresult bundle.
+type testCaseResult struct {
+	ClassName string `json:"class_name,omitempty"`
+	Name      string `json:"name"`
+	Status    string `json:"status"` // passed, failed, or error
+	Message   string `json:"message,omitempty"`
+}
+
+const (
+	testStatusPassed  = "passed"
+	testStatusFailed  = "failed"
+	testStatusError   = "error"
+	testStatusSkipped = "skipped"
+)
+
+const defaultAndroidRunner = "android.support.test.runner.AndroidJUnitRunner"
+
+// androidRunner resolves the instrumentation runner class to use, honoring
+// the runner= query param and otherwise preserving the historical default
+// (which predates androidx.test.runner.AndroidJUnitRunner).
+func androidRunner(query url.Values) string {
+	if runner := query.Get("runner"); runner != "" {
+		return runner
+	}
+	return defaultAndroidRunner
+}
+
+// androidFilterArgs turns a test_filter= query param into "-e class ..." or
+// "-e package ..." am instrument arguments. The value is prefixed with
+// "class:" or "package:" to select which, e.g. test_filter=class:com.foo.Bar.
+func androidFilterArgs(query url.Values) ([]string, error) {
+	filter := query.Get("test_filter")
+	if filter == "" {
+		return nil, nil
+	}
+	kind, value, ok := strings.Cut(filter, ":")
+	if !ok || value == "" {
+		return nil, fmt.Errorf("test_filter must be of the form 'class:<name>' or 'package:<name>'")
+	}
+	switch kind {
+	case "class", "package":
+		return []string{"-e", kind, value}, nil
+	default:
+		return nil, fmt.Errorf("unsupported test_filter kind %q", kind)
+	}
+}
+
+// parseInstrumentationOutput parses the key/value INSTRUMENTATION_STATUS
+// stream produced by "am instrument -r -w" into per-test outcomes.
+func parseInstrumentationOutput(output string) []testCaseResult {
+	var results []testCaseResult
+	var class, test, stack string
+	var code int
+
+	flush := func() {
+		if test == "" {
+			return
+		}
+		status := testStatusPassed
+		switch code {
+		case -2:
+			status = testStatusFailed
+		case -1:
+			status = testStatusError
+		case -3, -4: // -3 == @Ignore'd, -4 == assumption failure (e.g. assumeTrue)
+			status = testStatusSkipped
+		}
+		results = append(results, testCaseResult{ClassName: class, Name: test, Status: status, Message: strings.TrimSpace(stack)})
+		test, stack, code = "", "", 0
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "INSTRUMENTATION_STATUS_CODE:"):
+			v := strings.TrimSpace(strings.TrimPrefix(line, "INSTRUMENTATION_STATUS_CODE:"))
+			code, _ = strconv.Atoi(v)
+			if code != 1 { // 1 == test started; anything else means it finished
+				flush()
+			}
+		case strings.HasPrefix(line, "INSTRUMENTATION_STATUS:"):
+			kv := strings.TrimSpace(strings.TrimPrefix(line, "INSTRUMENTATION_STATUS:"))
+			key, value, ok := strings.Cut(kv, "=")
+			if !ok {
+				continue
+			}
+			switch strings.TrimSpace(key) {
+			case "class":
+				class = strings.TrimSpace(value)
+			case "test":
+				test = strings.TrimSpace(value)
+			case "stack":
+				stack = value
+			}
+		}
+	}
+
+	return results
+}
+
+// iosTestingArgs turns only_testing=/skip_testing= query params into
+// repeated -only-testing:/-skip-testing: xcodebuild flags.
+func iosTestingArgs(query url.Values) []string {
+	var args []string
+	for _, t := range splitCSV(query.Get("only_testing")) {
+		args = append(args, "-only-testing:"+t)
+	}
+	for _, t := range splitCSV(query.Get("skip_testing")) {
+		args = append(args, "-skip-testing:"+t)
+	}
+	return args
+}
+
+// xcresultRef is the {"id": {"_value": "..."}} shape xcresulttool uses
+// throughout its JSON to point at another object in the bundle.
+type xcresultRef struct {
+	ID struct {
+		Value string `json:"_value"`
+	} `json:"id"`
+}
+
+// xcresultTestNode is one node of the testableSummaries[].tests[] tree:
+// either a group (test target/class, identified by Subtests) or a leaf
+// test method (identified by a non-empty TestStatus).
+type xcresultTestNode struct {
+	Identifier struct {
+		Value string `json:"_value"`
+	} `json:"identifier"`
+	TestStatus struct {
+		Value string `json:"_value"`
+	} `json:"testStatus"`
+	FailureSummaries struct {
+		Values []struct {
+			Message struct {
+				Value string `json:"_value"`
+			} `json:"message"`
+		} `json:"_values"`
+	} `json:"failureSummaries"`
+	Subtests struct {
+		Values []xcresultTestNode `json:"_values"`
+	} `json:"subtests"`
+}
+
+// leaves walks the node recursively and appends every actual test method
+// (as opposed to group/class nodes) it finds to results.
+func (n xcresultTestNode) leaves(results *[]testCaseResult) {
+	if len(n.Subtests.Values) > 0 {
+		for _, sub := range n.Subtests.Values {
+			sub.leaves(results)
+		}
+		return
+	}
+	if n.TestStatus.Value == "" {
+		return
+	}
+
+	class, name, _ := strings.Cut(n.Identifier.Value, "/")
+	status := testStatusPassed
+	message := ""
+	switch n.TestStatus.Value {
+	case "Success":
+	case "Skipped", "Expected Failure":
+		// XCTSkip (or a plan marking the test skipped) and XCTExpectFailure
+		// both report as healthy outcomes, not failures.
+		status = testStatusSkipped
+	default:
+		status = testStatusFailed
+		if len(n.FailureSummaries.Values) > 0 {
+			message = n.FailureSummaries.Values[0].Message.Value
+		}
+	}
+	*results = append(*results, testCaseResult{ClassName: class, Name: name, Status: status, Message: message})
+}
+
+// xcresultGet runs `xcrun xcresulttool get --format json` against a result
+// bundle, optionally targeting a specific object id within it.
+func xcresultGet(bundlePath, id string) ([]byte, error) {
+	args := []string{"xcresulttool", "get", "--format", "json", "--path", bundlePath}
+	if id != "" {
+		args = append(args, "--id", id)
+	}
+	out, err := exec.Command("xcrun", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("xcresulttool: %w", err)
+	}
+	return out, nil
+}
+
+// xcresultTestCases invokes `xcrun xcresulttool get` against a result
+// bundle produced by an xcodebuild -resultBundlePath run and extracts
+// per-test outcomes, passing and failing alike, from its JSON summary by
+// walking the testPlanRunSummaries tree referenced from each action.
+func xcresultTestCases(bundlePath string) ([]testCaseResult, error) {
+	out, err := xcresultGet(bundlePath, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var root struct {
+		Actions struct {
+			Values []struct {
+				ActionResult struct {
+					TestsRef *xcresultRef `json:"testsRef"`
+				} `json:"actionResult"`
+			} `json:"_values"`
+		} `json:"actions"`
+	}
+	if err := json.Unmarshal(out, &root); err != nil {
+		return nil, fmt.Errorf("parsing xcresult json: %w", err)
+	}
+
+	var results []testCaseResult
+	for _, action := range root.Actions.Values {
+		ref := action.ActionResult.TestsRef
+		if ref == nil || ref.ID.Value == "" {
+			continue
+		}
+		summaryJSON, err := xcresultGet(bundlePath, ref.ID.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		var summaries struct {
+			Summaries struct {
+				Values []struct {
+					TestableSummaries struct {
+						Values []struct {
+							Tests struct {
+								Values []xcresultTestNode `json:"_values"`
+							} `json:"tests"`
+						} `json:"_values"`
+					} `json:"testableSummaries"`
+				} `json:"_values"`
+			} `json:"summaries"`
+		}
+		if err := json.Unmarshal(summaryJSON, &summaries); err != nil {
+			return nil, fmt.Errorf("parsing xcresult test summary json: %w", err)
+		}
+		for _, runSummary := range summaries.Summaries.Values {
+			for _, testable := range runSummary.TestableSummaries.Values {
+				for _, test := range testable.Tests.Values {
+					test.leaves(&results)
+				}
+			}
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseInstrumentationOutput(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []testCaseResult
+	}{
+		{
+			name: "passing test",
+			output: "INSTRUMENTATION_STATUS: class=com.foo.BarTest\n" +
+				"INSTRUMENTATION_STATUS: test=testBaz\n" +
+				"INSTRUMENTATION_STATUS_CODE: 1\n" +
+				"INSTRUMENTATION_STATUS_CODE: 0\n",
+			want: []testCaseResult{
+				{ClassName: "com.foo.BarTest", Name: "testBaz", Status: testStatusPassed},
+			},
+		},
+		{
+			name: "failing test carries the stack trace",
+			output: "INSTRUMENTATION_STATUS: class=com.foo.BarTest\n" +
+				"INSTRUMENTATION_STATUS: test=testBaz\n" +
+				"INSTRUMENTATION_STATUS_CODE: 1\n" +
+				"INSTRUMENTATION_STATUS: stack=java.lang.AssertionError: expected true\n" +
+				"INSTRUMENTATION_STATUS_CODE: -2\n",
+			want: []testCaseResult{
+				{ClassName: "com.foo.BarTest", Name: "testBaz", Status: testStatusFailed, Message: "java.lang.AssertionError: expected true"},
+			},
+		},
+		{
+			name: "errored test",
+			output: "INSTRUMENTATION_STATUS: class=com.foo.BarTest\n" +
+				"INSTRUMENTATION_STATUS: test=testBaz\n" +
+				"INSTRUMENTATION_STATUS_CODE: 1\n" +
+				"INSTRUMENTATION_STATUS: stack=java.lang.RuntimeException: boom\n" +
+				"INSTRUMENTATION_STATUS_CODE: -1\n",
+			want: []testCaseResult{
+				{ClassName: "com.foo.BarTest", Name: "testBaz", Status: testStatusError, Message: "java.lang.RuntimeException: boom"},
+			},
+		},
+		{
+			name: "multiple tests",
+			output: "INSTRUMENTATION_STATUS: class=com.foo.BarTest\n" +
+				"INSTRUMENTATION_STATUS: test=testOne\n" +
+				"INSTRUMENTATION_STATUS_CODE: 1\n" +
+				"INSTRUMENTATION_STATUS_CODE: 0\n" +
+				"INSTRUMENTATION_STATUS: class=com.foo.BarTest\n" +
+				"INSTRUMENTATION_STATUS: test=testTwo\n" +
+				"INSTRUMENTATION_STATUS_CODE: 1\n" +
+				"INSTRUMENTATION_STATUS_CODE: -2\n",
+			want: []testCaseResult{
+				{ClassName: "com.foo.BarTest", Name: "testOne", Status: testStatusPassed},
+				{ClassName: "com.foo.BarTest", Name: "testTwo", Status: testStatusFailed},
+			},
+		},
+		{
+			name: "ignored test is skipped, not passed",
+			output: "INSTRUMENTATION_STATUS: class=com.foo.BarTest\n" +
+				"INSTRUMENTATION_STATUS: test=testBaz\n" +
+				"INSTRUMENTATION_STATUS_CODE: 1\n" +
+				"INSTRUMENTATION_STATUS_CODE: -3\n",
+			want: []testCaseResult{
+				{ClassName: "com.foo.BarTest", Name: "testBaz", Status: testStatusSkipped},
+			},
+		},
+		{
+			name: "assumption failure is skipped, not passed",
+			output: "INSTRUMENTATION_STATUS: class=com.foo.BarTest\n" +
+				"INSTRUMENTATION_STATUS: test=testBaz\n" +
+				"INSTRUMENTATION_STATUS_CODE: 1\n" +
+				"INSTRUMENTATION_STATUS_CODE: -4\n",
+			want: []testCaseResult{
+				{ClassName: "com.foo.BarTest", Name: "testBaz", Status: testStatusSkipped},
+			},
+		},
+		{
+			name:   "empty output yields no results",
+			output: "",
+			want:   nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseInstrumentationOutput(tt.output)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parseInstrumentationOutput() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestXcresultTestNodeLeaves(t *testing.T) {
+	leaf := func(id, status, failureMsg string) xcresultTestNode {
+		n := xcresultTestNode{}
+		n.Identifier.Value = id
+		n.TestStatus.Value = status
+		if failureMsg != "" {
+			n.FailureSummaries.Values = []struct {
+				Message struct {
+					Value string `json:"_value"`
+				} `json:"message"`
+			}{{Message: struct {
+				Value string `json:"_value"`
+			}{Value: failureMsg}}}
+		}
+		return n
+	}
+
+	group := xcresultTestNode{}
+	group.Subtests.Values = []xcresultTestNode{
+		leaf("BarTest/testOne()", "Success", ""),
+		leaf("BarTest/testTwo()", "Failure", "expected true"),
+		leaf("BarTest/testThree()", "Skipped", ""),
+		leaf("BarTest/testFour()", "Expected Failure", ""),
+	}
+
+	// A group node itself carries no TestStatus, so only its leaves surface.
+	var results []testCaseResult
+	group.leaves(&results)
+
+	want := []testCaseResult{
+		{ClassName: "BarTest", Name: "testOne()", Status: testStatusPassed},
+		{ClassName: "BarTest", Name: "testTwo()", Status: testStatusFailed, Message: "expected true"},
+		{ClassName: "BarTest", Name: "testThree()", Status: testStatusSkipped},
+		{ClassName: "BarTest", Name: "testFour()", Status: testStatusSkipped},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Fatalf("leaves() = %+v, want %+v", results, want)
+	}
+}
+
+func TestXcresultTestNodeLeavesNestedGroups(t *testing.T) {
+	inner := xcresultTestNode{}
+	inner.Subtests.Values = []xcresultTestNode{
+		func() xcresultTestNode {
+			n := xcresultTestNode{}
+			n.Identifier.Value = "BarTest/testNested()"
+			n.TestStatus.Value = "Success"
+			return n
+		}(),
+	}
+	outer := xcresultTestNode{}
+	outer.Subtests.Values = []xcresultTestNode{inner}
+
+	var results []testCaseResult
+	outer.leaves(&results)
+
+	want := []testCaseResult{
+		{ClassName: "BarTest", Name: "testNested()", Status: testStatusPassed},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Fatalf("leaves() = %+v, want %+v", results, want)
+	}
+}
+
+func TestAndroidFilterArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  string
+		want    []string
+		wantErr bool
+	}{
+		{name: "no filter", filter: "", want: nil},
+		{name: "class filter", filter: "class:com.foo.BarTest", want: []string{"-e", "class", "com.foo.BarTest"}},
+		{name: "package filter", filter: "package:com.foo", want: []string{"-e", "package", "com.foo"}},
+		{name: "missing value", filter: "class:", wantErr: true},
+		{name: "missing kind separator", filter: "com.foo.BarTest", wantErr: true},
+		{name: "unsupported kind", filter: "method:testBaz", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := url.Values{}
+			if tt.filter != "" {
+				query.Set("test_filter", tt.filter)
+			}
+			got, err := androidFilterArgs(query)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("androidFilterArgs(%q) = %v, want error", tt.filter, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("androidFilterArgs(%q) unexpected error: %v", tt.filter, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("androidFilterArgs(%q) = %v, want %v", tt.filter, got, tt.want)
+			}
+		})
+	}
+}
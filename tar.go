@@ -0,0 +1,156 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	maxTarEntries   = flag.Int("max-tar-entries", 10000, "maximum number of entries allowed in an uploaded source tarball")
+	maxTarFileSize  = flag.Int64("max-tar-file-size", 100<<20, "maximum uncompressed size in bytes of a single file within an uploaded source tarball")
+	maxTarTotalSize = flag.Int64("max-tar-total-size", 500<<20, "maximum total uncompressed size in bytes of an uploaded source tarball")
+)
+
+// tarEntryError names the offending entry in a rejected tarball, so callers
+// can report a structured 400 instead of a bare error string.
+type tarEntryError struct {
+	Entry string
+	Err   error
+}
+
+func (e *tarEntryError) Error() string {
+	return fmt.Sprintf("tar entry %q: %v", e.Entry, e.Err)
+}
+
+func (e *tarEntryError) Unwrap() error {
+	return e.Err
+}
+
+// extractTarGz safely extracts a gzip-compressed tarball into destDir, which
+// must already exist. Every entry is validated before anything is written:
+// absolute paths and ".." traversal are rejected, symlinks/hardlinks whose
+// target would resolve outside destDir are rejected, and the total entry
+// count, per-file size, and total uncompressed size are capped to guard
+// against decompression bombs.
+func extractTarGz(src, destDir string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+
+	var entries int
+	var totalSize int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		entries++
+		if entries > *maxTarEntries {
+			return &tarEntryError{Entry: hdr.Name, Err: fmt.Errorf("tarball exceeds %d entry limit", *maxTarEntries)}
+		}
+
+		target, err := safeTarJoin(destDir, hdr.Name)
+		if err != nil {
+			return &tarEntryError{Entry: hdr.Name, Err: err}
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return &tarEntryError{Entry: hdr.Name, Err: err}
+			}
+
+		case tar.TypeReg:
+			if hdr.Size > *maxTarFileSize {
+				return &tarEntryError{Entry: hdr.Name, Err: fmt.Errorf("file exceeds %d byte limit", *maxTarFileSize)}
+			}
+			totalSize += hdr.Size
+			if totalSize > *maxTarTotalSize {
+				return &tarEntryError{Entry: hdr.Name, Err: fmt.Errorf("tarball exceeds %d byte uncompressed size limit", *maxTarTotalSize)}
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return &tarEntryError{Entry: hdr.Name, Err: err}
+			}
+			out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(hdr.Mode)&0777)
+			if err != nil {
+				return &tarEntryError{Entry: hdr.Name, Err: err}
+			}
+			_, err = io.CopyN(out, tr, hdr.Size)
+			out.Close()
+			if err != nil {
+				return &tarEntryError{Entry: hdr.Name, Err: err}
+			}
+
+		case tar.TypeSymlink, tar.TypeLink:
+			if err := safeTarLinkTarget(destDir, hdr.Name, hdr.Linkname); err != nil {
+				return &tarEntryError{Entry: hdr.Name, Err: err}
+			}
+			if hdr.Typeflag == tar.TypeSymlink {
+				if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+					return &tarEntryError{Entry: hdr.Name, Err: err}
+				}
+				if err := os.Symlink(hdr.Linkname, target); err != nil {
+					return &tarEntryError{Entry: hdr.Name, Err: err}
+				}
+			} else {
+				linkTarget, err := safeTarJoin(destDir, hdr.Linkname)
+				if err != nil {
+					return &tarEntryError{Entry: hdr.Name, Err: err}
+				}
+				if err := os.Link(linkTarget, target); err != nil {
+					return &tarEntryError{Entry: hdr.Name, Err: err}
+				}
+			}
+
+		default:
+			return &tarEntryError{Entry: hdr.Name, Err: fmt.Errorf("unsupported tar entry type %q", hdr.Typeflag)}
+		}
+	}
+}
+
+// safeTarJoin resolves name against root, rejecting absolute paths and any
+// ".." component that would let the entry escape root.
+func safeTarJoin(root, name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return "", fmt.Errorf("absolute path not allowed")
+	}
+	cleaned := filepath.Clean(name)
+	if cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path escapes extraction root")
+	}
+	return filepath.Join(root, cleaned), nil
+}
+
+// safeTarLinkTarget rejects symlink/hardlink targets that would resolve
+// outside root, whether given as an absolute path or via "..".
+func safeTarLinkTarget(root, entryName, linkname string) error {
+	if filepath.IsAbs(linkname) {
+		return fmt.Errorf("absolute link target not allowed")
+	}
+	target := filepath.Join(root, filepath.Dir(entryName), linkname)
+	rel, err := filepath.Rel(root, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("link target escapes extraction root")
+	}
+	return nil
+}
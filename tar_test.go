@@ -0,0 +1,154 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSafeTarJoin(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   string
+		wantErr bool
+	}{
+		{name: "plain file", entry: "foo/bar.txt"},
+		{name: "absolute path", entry: "/etc/passwd", wantErr: true},
+		{name: "parent traversal", entry: "../etc/passwd", wantErr: true},
+		{name: "nested parent traversal", entry: "foo/../../etc/passwd", wantErr: true},
+		{name: "traversal that cancels out stays inside root", entry: "foo/../bar.txt"},
+		{name: "bare dotdot", entry: "..", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := safeTarJoin("/root", tt.entry)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("safeTarJoin(%q) = %q, want error", tt.entry, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("safeTarJoin(%q) unexpected error: %v", tt.entry, err)
+			}
+			if rel, err := filepath.Rel("/root", got); err != nil || rel == ".." || filepathHasDotDotPrefix(rel) {
+				t.Fatalf("safeTarJoin(%q) = %q, escapes root", tt.entry, got)
+			}
+		})
+	}
+}
+
+func filepathHasDotDotPrefix(rel string) bool {
+	return len(rel) >= 3 && rel[:3] == ".."+string(filepath.Separator)
+}
+
+func TestSafeTarLinkTarget(t *testing.T) {
+	tests := []struct {
+		name      string
+		entryName string
+		linkname  string
+		wantErr   bool
+	}{
+		{name: "sibling target", entryName: "foo/link", linkname: "bar.txt"},
+		{name: "absolute target", entryName: "foo/link", linkname: "/etc/passwd", wantErr: true},
+		{name: "traversal target", entryName: "foo/link", linkname: "../../etc/passwd", wantErr: true},
+		{name: "traversal that stays inside root", entryName: "foo/bar/link", linkname: "../sibling.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := safeTarLinkTarget("/root", tt.entryName, tt.linkname)
+			if tt.wantErr && err == nil {
+				t.Fatalf("safeTarLinkTarget(%q, %q) = nil, want error", tt.entryName, tt.linkname)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("safeTarLinkTarget(%q, %q) unexpected error: %v", tt.entryName, tt.linkname, err)
+			}
+		})
+	}
+}
+
+// buildTarGz builds an in-memory gzip-compressed tarball from the given
+// entries, so extractTarGz can be exercised against crafted malicious
+// archives without touching disk for the input side.
+func buildTarGz(t *testing.T, entries []*tar.Header) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, hdr := range entries {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader: %v", err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tw.Write(make([]byte, hdr.Size)); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tar Close: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("gzip Close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func writeTarGz(t *testing.T, data []byte) string {
+	t.Helper()
+	f, err := os.CreateTemp(t.TempDir(), "malicious-*.tgz")
+	if err != nil {
+		t.Fatalf("CreateTemp: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	return f.Name()
+}
+
+func TestExtractTarGzRejectsPathTraversal(t *testing.T) {
+	data := buildTarGz(t, []*tar.Header{
+		{Name: "../../etc/passwd", Typeflag: tar.TypeReg, Size: 0, Mode: 0644},
+	})
+	src := writeTarGz(t, data)
+	destDir := t.TempDir()
+
+	if err := extractTarGz(src, destDir); err == nil {
+		t.Fatal("extractTarGz accepted a path-traversal entry, want error")
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(destDir), "etc", "passwd")); !os.IsNotExist(err) {
+		t.Fatal("path-traversal entry escaped destDir")
+	}
+}
+
+func TestExtractTarGzRejectsSymlinkEscape(t *testing.T) {
+	data := buildTarGz(t, []*tar.Header{
+		{Name: "evil", Typeflag: tar.TypeSymlink, Linkname: "../../etc", Mode: 0777},
+	})
+	src := writeTarGz(t, data)
+	destDir := t.TempDir()
+
+	if err := extractTarGz(src, destDir); err == nil {
+		t.Fatal("extractTarGz accepted a symlink escaping destDir, want error")
+	}
+}
+
+func TestExtractTarGzAcceptsWellFormedArchive(t *testing.T) {
+	data := buildTarGz(t, []*tar.Header{
+		{Name: "src/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "src/main.go", Typeflag: tar.TypeReg, Size: 4, Mode: 0644},
+	})
+	src := writeTarGz(t, data)
+	destDir := t.TempDir()
+
+	if err := extractTarGz(src, destDir); err != nil {
+		t.Fatalf("extractTarGz rejected a well-formed archive: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "src", "main.go")); err != nil {
+		t.Fatalf("expected extracted file: %v", err)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var uploadTTL = flag.Duration("upload-ttl", 30*time.Minute, "how long a resumable upload may sit idle with no chunks before it is reaped")
+
+// artifactDigestHeader carries the client-supplied hex SHA-256 digest of the
+// uploaded artifact (APK or iOS source tarball).
+const artifactDigestHeader = "X-Artifact-SHA256"
+
+// streamToFileWithDigest copies body into file while computing its SHA-256
+// digest, without ever buffering the whole artifact in memory.
+func streamToFileWithDigest(body io.Reader, file *os.File) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, h), body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checkArtifactDigest compares a computed digest against the client-supplied
+// X-Artifact-SHA256 header, if any was sent. A missing header skips
+// verification so existing callers keep working.
+func checkArtifactDigest(r *http.Request, digest string) error {
+	want := r.Header.Get(artifactDigestHeader)
+	if want == "" {
+		return nil
+	}
+	if !strings.EqualFold(want, digest) {
+		return fmt.Errorf("artifact digest mismatch: want %s got %s", want, digest)
+	}
+	return nil
+}
+
+// uploadsDir returns (creating if necessary) the directory used to track
+// in-progress resumable uploads.
+func uploadsDir() (string, error) {
+	dir := filepath.Join(os.TempDir(), "dpharmd-uploads")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// partialUpload tracks one resumable, chunked upload identified by an
+// Upload-Id query param. Chunks are required to arrive in order (i.e. to
+// resume from wherever the previous attempt left off), which is the case
+// BoringSSL-style CI clients retry with after a dropped connection.
+type partialUpload struct {
+	mu             sync.Mutex
+	path           string
+	file           *os.File
+	hasher         hash.Hash
+	total          int64
+	received       int64
+	lastChunkStart int64
+	lastActive     time.Time
+	reaped         bool
+}
+
+var (
+	partialUploadsMu sync.Mutex
+	partialUploads   = map[string]*partialUpload{}
+)
+
+func getOrCreatePartialUpload(id string, total int64) (*partialUpload, error) {
+	partialUploadsMu.Lock()
+	defer partialUploadsMu.Unlock()
+
+	if up, ok := partialUploads[id]; ok {
+		return up, nil
+	}
+
+	dir, err := uploadsDir()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("upload_%s.part", id))
+	// O_TRUNC matters here: reapStaleUploads deletes the map entry before
+	// os.Removing the file, so an Upload-Id reused in that window would
+	// otherwise reopen the reaped upload's inode at offset 0 without
+	// clearing it, leaving its stale trailing bytes past the new upload's
+	// length in the finalized file.
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	up := &partialUpload{path: path, file: file, hasher: sha256.New(), total: total, lastChunkStart: -1, lastActive: time.Now()}
+	partialUploads[id] = up
+	return up, nil
+}
+
+func forgetPartialUpload(id string) {
+	partialUploadsMu.Lock()
+	defer partialUploadsMu.Unlock()
+	delete(partialUploads, id)
+}
+
+// reapStaleUploads discards any partial upload that has received no chunk
+// for longer than *uploadTTL, so a client that starts a resumable upload and
+// disappears doesn't leak a tracked file and map entry forever. Closing the
+// file happens while still holding up.mu, the same lock pendingChunk.commit
+// holds for the duration of its write, so a chunk that's mid-copy can't have
+// its fd closed out from under it; reaped is also set so that if commit was
+// already past the lock (about to reuse up after a lookup race) it still
+// refuses to write to a file we've removed.
+func reapStaleUploads() {
+	var reapedPaths []string
+
+	partialUploadsMu.Lock()
+	cutoff := time.Now().Add(-*uploadTTL)
+	for id, up := range partialUploads {
+		up.mu.Lock()
+		if up.lastActive.Before(cutoff) {
+			up.reaped = true
+			up.file.Close()
+			reapedPaths = append(reapedPaths, up.path)
+			delete(partialUploads, id)
+		}
+		up.mu.Unlock()
+	}
+	partialUploadsMu.Unlock()
+
+	for _, path := range reapedPaths {
+		log.Printf("upload: reaping stale partial upload %s", path)
+		os.Remove(path)
+	}
+}
+
+// runUploadReaper periodically reaps stale partial uploads for as long as
+// the process runs.
+func runUploadReaper() {
+	for range time.Tick(*uploadTTL / 2) {
+		reapStaleUploads()
+	}
+}
+
+// parseContentRange parses a "bytes start-end/total" Content-Range request
+// header, as sent for a single resumable PUT chunk.
+func parseContentRange(s string) (start, end, total int64, err error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "bytes ")
+	spec, totalStr, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range %q", s)
+	}
+	if total, err = strconv.ParseInt(totalStr, 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range total in %q", s)
+	}
+	startStr, endStr, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range range in %q", s)
+	}
+	if start, err = strconv.ParseInt(startStr, 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range start in %q", s)
+	}
+	if end, err = strconv.ParseInt(endStr, 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range end in %q", s)
+	}
+	return start, end, total, nil
+}
+
+// chunkResult reports the outcome of accepting one resumable upload chunk.
+type chunkResult struct {
+	Done     bool
+	Path     string
+	Received int64
+	Total    int64
+}
+
+// pendingChunk holds a resumable upload chunk read into memory but not yet
+// applied to its partialUpload. authenticate only checks for a known keyid
+// plus a fresh nonce/timestamp, not the signature itself (that requires the
+// full body hash, so verifyBody runs after the body has been read); staging
+// a chunk here rather than writing it straight through means a request that
+// later fails verifyBody never touched the shared file, hasher, or
+// bookkeeping, so it can't corrupt or (via abortUpload) discard a legitimate
+// upload in progress. Call commit only once verifyBody has succeeded.
+type pendingChunk struct {
+	up       *partialUpload
+	uploadID string
+	start    int64
+	end      int64
+	data     []byte
+}
+
+// stageChunk reads a single Content-Range chunk into memory without
+// mutating the named partial upload.
+func stageChunk(body io.Reader, uploadID string, start, end, total int64) (*pendingChunk, error) {
+	up, err := getOrCreatePartialUpload(uploadID, total)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(body, end-start+1))
+	if err != nil {
+		return nil, err
+	}
+	return &pendingChunk{up: up, uploadID: uploadID, start: start, end: end, data: data}, nil
+}
+
+// commit applies a staged chunk to its partial upload now that the
+// request's signature has been verified. Once the full artifact has been
+// received, its digest is checked against wantDigest (if non-empty) and
+// Done is reported so the caller can move the finalized file out of the
+// tracked upload directory.
+func (p *pendingChunk) commit(wantDigest string) (chunkResult, error) {
+	up := p.up
+	up.mu.Lock()
+	defer up.mu.Unlock()
+
+	if up.reaped {
+		return chunkResult{}, fmt.Errorf("upload %q was reaped after sitting idle past -upload-ttl", p.uploadID)
+	}
+
+	if p.start != up.received {
+		// A client that never saw our ack for the last chunk it sent will
+		// retry with a freshly signed request (new nonce/ts, so it isn't
+		// rejected as a replay) carrying the same Content-Range; treat that
+		// resend as a no-op instead of aborting the whole upload, since its
+		// bytes are already on disk.
+		if p.start == up.lastChunkStart && p.end == up.received-1 {
+			up.lastActive = time.Now()
+			return chunkResult{Done: false, Received: up.received, Total: up.total}, nil
+		}
+		return chunkResult{}, fmt.Errorf("expected chunk starting at %d, got %d", up.received, p.start)
+	}
+
+	n, err := io.Copy(io.MultiWriter(up.file, up.hasher), bytes.NewReader(p.data))
+	if err != nil {
+		return chunkResult{}, err
+	}
+	up.lastChunkStart = p.start
+	up.received += n
+	up.lastActive = time.Now()
+
+	if up.received < up.total {
+		return chunkResult{Done: false, Received: up.received, Total: up.total}, nil
+	}
+
+	digest := hex.EncodeToString(up.hasher.Sum(nil))
+	if wantDigest != "" && !strings.EqualFold(digest, wantDigest) {
+		return chunkResult{}, fmt.Errorf("artifact digest mismatch: want %s got %s", wantDigest, digest)
+	}
+
+	up.file.Close()
+	forgetPartialUpload(p.uploadID)
+	return chunkResult{Done: true, Path: up.path, Received: up.received, Total: up.total}, nil
+}
+
+// abortUpload discards a partial upload after an unrecoverable error (e.g. a
+// digest mismatch or an out-of-order chunk).
+func abortUpload(uploadID string) {
+	partialUploadsMu.Lock()
+	up, ok := partialUploads[uploadID]
+	delete(partialUploads, uploadID)
+	partialUploadsMu.Unlock()
+
+	if ok {
+		up.file.Close()
+		os.Remove(up.path)
+	}
+}
+
+// receiveIOSSource reads the uploaded iOS source tarball for a single
+// request, honoring resumable chunked transfer when an Upload-Id query
+// param is present. On success it returns either the path to a fully
+// received, digest-verified tarball (done == true), or a progress report
+// for a non-final chunk (done == false) that the caller should report back
+// to the client as a 202 Accepted once the request's signature has been
+// verified.
+func receiveIOSSource(r *http.Request, query url.Values) (path string, done bool, progress chunkResult, err error) {
+	uploadID := query.Get("Upload-Id")
+	if uploadID == "" {
+		dir := os.TempDir()
+		name := filepath.Join(dir, fmt.Sprintf("source_%s.tgz", RandomAlphaNumericString(5)))
+		file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return "", false, chunkResult{}, err
+		}
+		digest, err := streamToFileWithDigest(r.Body, file)
+		file.Close()
+		if err != nil {
+			os.Remove(name)
+			return "", false, chunkResult{}, err
+		}
+		if err := verifyBody(r); err != nil {
+			os.Remove(name)
+			return "", false, chunkResult{}, err
+		}
+		if err := checkArtifactDigest(r, digest); err != nil {
+			os.Remove(name)
+			return "", false, chunkResult{}, err
+		}
+		return name, true, chunkResult{}, nil
+	}
+
+	contentRange := r.Header.Get("Content-Range")
+	if contentRange == "" {
+		return "", false, chunkResult{}, fmt.Errorf("resumable uploads require a Content-Range header")
+	}
+	start, end, total, err := parseContentRange(contentRange)
+	if err != nil {
+		return "", false, chunkResult{}, err
+	}
+
+	pending, err := stageChunk(r.Body, uploadID, start, end, total)
+	if err != nil {
+		abortUpload(uploadID)
+		return "", false, chunkResult{}, err
+	}
+	if verifyErr := verifyBody(r); verifyErr != nil {
+		// Nothing has been applied to the upload yet, so a forged
+		// signature can't corrupt or discard a legitimate upload's
+		// progress; just reject this request and leave it untouched.
+		return "", false, chunkResult{}, verifyErr
+	}
+
+	result, err := pending.commit(r.Header.Get(artifactDigestHeader))
+	if err != nil {
+		abortUpload(uploadID)
+		return "", false, chunkResult{}, err
+	}
+	if !result.Done {
+		return "", false, result, nil
+	}
+	return result.Path, true, chunkResult{}, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		name      string
+		header    string
+		wantStart int64
+		wantEnd   int64
+		wantTotal int64
+		wantErr   bool
+	}{
+		{name: "valid range", header: "bytes 0-999/5000", wantStart: 0, wantEnd: 999, wantTotal: 5000},
+		{name: "valid final chunk", header: "bytes 4000-4999/5000", wantStart: 4000, wantEnd: 4999, wantTotal: 5000},
+		{name: "missing bytes prefix still parses", header: "0-999/5000", wantStart: 0, wantEnd: 999, wantTotal: 5000},
+		{name: "missing total", header: "bytes 0-999", wantErr: true},
+		{name: "missing range separator", header: "bytes 0999/5000", wantErr: true},
+		{name: "non-numeric total", header: "bytes 0-999/abc", wantErr: true},
+		{name: "non-numeric start", header: "bytes abc-999/5000", wantErr: true},
+		{name: "non-numeric end", header: "bytes 0-abc/5000", wantErr: true},
+		{name: "empty", header: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, total, err := parseContentRange(tt.header)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseContentRange(%q) = (%d, %d, %d), want error", tt.header, start, end, total)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseContentRange(%q) unexpected error: %v", tt.header, err)
+			}
+			if start != tt.wantStart || end != tt.wantEnd || total != tt.wantTotal {
+				t.Fatalf("parseContentRange(%q) = (%d, %d, %d), want (%d, %d, %d)",
+					tt.header, start, end, total, tt.wantStart, tt.wantEnd, tt.wantTotal)
+			}
+		})
+	}
+}
+
+// acceptChunk stages and immediately commits a chunk, standing in for the
+// stage-then-verify-then-commit sequence receiveIOSSource drives once a
+// request's signature has checked out.
+func acceptChunk(body io.Reader, uploadID string, start, end, total int64, wantDigest string) (chunkResult, error) {
+	pending, err := stageChunk(body, uploadID, start, end, total)
+	if err != nil {
+		return chunkResult{}, err
+	}
+	return pending.commit(wantDigest)
+}
+
+func TestAcceptChunkExactResendIsIdempotent(t *testing.T) {
+	uploadID := "resend-" + RandomAlphaNumericString(8)
+
+	first, err := acceptChunk(strings.NewReader("hello"), uploadID, 0, 4, 10, "")
+	if err != nil {
+		t.Fatalf("first chunk: unexpected error: %v", err)
+	}
+	if first.Done || first.Received != 5 {
+		t.Fatalf("first chunk: got %+v", first)
+	}
+
+	resend, err := acceptChunk(strings.NewReader("hello"), uploadID, 0, 4, 10, "")
+	if err != nil {
+		t.Fatalf("resend of accepted chunk: unexpected error: %v", err)
+	}
+	if resend.Received != 5 {
+		t.Fatalf("resend of accepted chunk: got %+v, bytes should not be double-counted", resend)
+	}
+
+	if _, err := acceptChunk(strings.NewReader("world"), uploadID, 2, 6, 10, ""); err == nil {
+		t.Fatal("out-of-order (non-resend) chunk should still be rejected")
+	}
+
+	abortUpload(uploadID)
+}
+
+// TestStageChunkDoesNotMutateUploadUntilCommit is the regression test for
+// the signature-bypass this staging split closes: a chunk that's been read
+// off the wire but not yet committed must not have touched the partial
+// upload's received count, file contents, or hasher, so a request that
+// later fails verifyBody can be dropped without corrupting or discarding
+// anyone's in-progress upload.
+func TestStageChunkDoesNotMutateUploadUntilCommit(t *testing.T) {
+	uploadID := "stage-" + RandomAlphaNumericString(8)
+
+	pending, err := stageChunk(strings.NewReader("hello"), uploadID, 0, 4, 10)
+	if err != nil {
+		t.Fatalf("stageChunk: %v", err)
+	}
+
+	up := pending.up
+	up.mu.Lock()
+	received := up.received
+	lastChunkStart := up.lastChunkStart
+	up.mu.Unlock()
+	if received != 0 || lastChunkStart != -1 {
+		t.Fatalf("stageChunk mutated the upload before commit: received=%d lastChunkStart=%d", received, lastChunkStart)
+	}
+
+	data, err := os.ReadFile(up.path)
+	if err != nil {
+		t.Fatalf("reading upload file: %v", err)
+	}
+	if len(data) != 0 {
+		t.Fatalf("stageChunk wrote %d bytes to the upload file before commit, want 0", len(data))
+	}
+
+	// Simulate a forged signature: the caller drops the pending chunk
+	// without committing it, exactly as receiveIOSSource does when
+	// verifyBody fails.
+	abortUpload(uploadID)
+}
+
+// TestGetOrCreatePartialUploadTruncatesStaleFile reproduces the window
+// between reapStaleUploads dropping an id from the map and later removing
+// its file: if a new upload reuses that id before the os.Remove runs, it
+// must not see the reaped upload's leftover bytes past its own length.
+func TestGetOrCreatePartialUploadTruncatesStaleFile(t *testing.T) {
+	uploadID := "reuse-" + RandomAlphaNumericString(8)
+
+	first, err := getOrCreatePartialUpload(uploadID, 20)
+	if err != nil {
+		t.Fatalf("getOrCreatePartialUpload: %v", err)
+	}
+	if _, err := first.file.Write([]byte("stale bytes from a reaped upload")); err != nil {
+		t.Fatalf("writing stale bytes: %v", err)
+	}
+	path := first.path
+	// Simulate reapStaleUploads: drop the map entry but don't os.Remove the
+	// file yet, as happens in the window the comment above describes.
+	forgetPartialUpload(uploadID)
+
+	second, err := getOrCreatePartialUpload(uploadID, 10)
+	if err != nil {
+		t.Fatalf("getOrCreatePartialUpload (reuse): %v", err)
+	}
+	if second.path != path {
+		t.Fatalf("reused upload path = %q, want the same path %q", second.path, path)
+	}
+
+	if _, err := acceptChunk(strings.NewReader("0123456789"), uploadID, 0, 9, 10, ""); err != nil {
+		t.Fatalf("acceptChunk: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading finalized file: %v", err)
+	}
+	if string(data) != "0123456789" {
+		t.Fatalf("finalized file = %q, want exactly the new upload's 10 bytes with no stale trailer", data)
+	}
+}